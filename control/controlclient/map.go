@@ -9,6 +9,8 @@ import (
 	"log"
 	"net/netip"
 	"sort"
+	"sync"
+	"time"
 
 	"tailscale.com/envknob"
 	"tailscale.com/tailcfg"
@@ -21,6 +23,75 @@ import (
 	"tailscale.com/wgengine/filter"
 )
 
+// haRouteStaleThreshold is how long a HA subnet router candidate can go
+// without being seen before it's no longer considered eligible to be the
+// elected active peer for a route it advertises.
+const haRouteStaleThreshold = 5 * time.Minute
+
+// ChangeKind identifies the kind of a Change sent to a mapSession
+// subscriber.
+type ChangeKind int
+
+// The peer-scoped kinds are derived only from a MapResponse's OnlineChange
+// and PeersChangedPatch deltas and from HA subnet router elections. A peer
+// delivered whole in Peers or PeersChanged is not compared against its
+// previous state, so changes arriving that way produce no peer-scoped Change
+// other than an HA election change.
+const (
+	// ChangePeerOnline is sent when an OnlineChange entry or a
+	// PeersChangedPatch Online field sets a peer's Online bit.
+	// Change.NodeID and Change.Online are set.
+	ChangePeerOnline ChangeKind = iota
+	// ChangePeerRoutes is sent when a PeersChangedPatch changes a peer's
+	// PrimaryRoutes, AllowedIPs, or Hostinfo.RoutableIPs, and for peers
+	// affected by an HA subnet router re-election. Change.NodeID is set.
+	ChangePeerRoutes
+	// ChangePeerEndpoints is sent when a PeersChangedPatch changes a peer's
+	// Endpoints. Change.NodeID and Change.Endpoints are set.
+	ChangePeerEndpoints
+	// ChangeDERPMap is sent when the DERP map changes. Change.DERPMap is set.
+	ChangeDERPMap
+	// ChangeDNSConfig is sent when the DNS config changes. Change.DNSConfig
+	// is set.
+	ChangeDNSConfig
+	// ChangePacketFilter is sent when the packet filter changes.
+	ChangePacketFilter
+	// ChangeSSHPolicy is sent when the SSH policy changes. Change.SSHPolicy
+	// is set.
+	ChangeSSHPolicy
+	// ChangeTKA is sent when the tailnet key authority state changes.
+	ChangeTKA
+	// ChangeSelfNode is sent when the self node changes. Change.SelfNode is
+	// set.
+	ChangeSelfNode
+	// ChangeDomain is sent when the tailnet's domain changes. Change.Domain
+	// is set.
+	ChangeDomain
+)
+
+// Change is a single, narrowly-scoped change derived from an incremental
+// tailcfg.MapResponse, delivered to subscribers registered via
+// mapSession.Subscribe. Only the fields relevant to Kind are populated.
+type Change struct {
+	Kind ChangeKind
+
+	NodeID    tailcfg.NodeID // for peer-scoped kinds
+	Online    *bool          // for ChangePeerOnline
+	Endpoints []string       // for ChangePeerEndpoints
+
+	DERPMap   *tailcfg.DERPMap   // for ChangeDERPMap
+	DNSConfig *tailcfg.DNSConfig // for ChangeDNSConfig
+	SSHPolicy *tailcfg.SSHPolicy // for ChangeSSHPolicy
+	SelfNode  tailcfg.NodeView   // for ChangeSelfNode
+	Domain    string             // for ChangeDomain
+}
+
+// changeSub is a single subscriber registered via mapSession.Subscribe.
+type changeSub struct {
+	kinds map[ChangeKind]bool
+	ch    chan Change
+}
+
 // mapSession holds the state over a long-polled "map" request to the
 // control plane.
 //
@@ -82,6 +153,20 @@ type mapSession struct {
 	// netMapBuilding is non-nil during a netmapForResponse call,
 	// containing the value to be returned, once fully populated.
 	netMapBuilding *netmap.NetworkMap
+
+	// lastHAElected is the most recently computed elected result of
+	// electHARoutes, kept so publishHAElectionChanges can tell an actual
+	// re-election apart from a MapResponse that simply didn't change
+	// anything HA-related.
+	lastHAElected map[netip.Prefix]tailcfg.NodeID
+	// lastHACandidates is the most recently computed candidateIDs result of
+	// electHARoutes, kept alongside lastHAElected so
+	// publishHAElectionChanges can tell when a peer joins or leaves a
+	// prefix's candidate set, not just when the winner changes.
+	lastHACandidates map[netip.Prefix][]tailcfg.NodeID
+
+	subscribeMu sync.Mutex // guards subscribers
+	subscribers []*changeSub
 }
 
 // newMapSession returns a mostly unconfigured new mapSession.
@@ -149,6 +234,45 @@ func (ms *mapSession) Close() {
 	ms.sessionAliveCtxClose()
 }
 
+// Subscribe registers interest in Changes of the given kinds and returns a
+// channel on which they'll be delivered. The channel is buffered; if a
+// subscriber falls behind, new Changes are dropped for it rather than
+// blocking the mapSession.
+//
+// Subscribe is safe to call concurrently with itself and with the
+// mapSession's normal MapResponse processing; it's guarded by the same
+// mutex as publish.
+func (ms *mapSession) Subscribe(kinds ...ChangeKind) <-chan Change {
+	set := make(map[ChangeKind]bool, len(kinds))
+	for _, k := range kinds {
+		set[k] = true
+	}
+	sub := &changeSub{
+		kinds: set,
+		ch:    make(chan Change, 8),
+	}
+	ms.subscribeMu.Lock()
+	defer ms.subscribeMu.Unlock()
+	ms.subscribers = append(ms.subscribers, sub)
+	return sub.ch
+}
+
+// publish delivers c to every subscriber that asked for its Kind.
+func (ms *mapSession) publish(c Change) {
+	ms.subscribeMu.Lock()
+	defer ms.subscribeMu.Unlock()
+	for _, sub := range ms.subscribers {
+		if !sub.kinds[c.Kind] {
+			continue
+		}
+		select {
+		case sub.ch <- c:
+		default:
+			ms.logf("netmap: dropping Change %v for slow subscriber", c.Kind)
+		}
+	}
+}
+
 // HandleNonKeepAliveMapResponse handles a non-KeepAlive MapResponse (full or
 // incremental).
 //
@@ -198,6 +322,95 @@ func (ms *mapSession) HandleNonKeepAliveMapResponse(ctx context.Context, resp *t
 	return nil
 }
 
+// publishPeerDeltas publishes ChangePeerOnline and ChangePeerEndpoints (and,
+// for a direct PrimaryRoutes/AllowedIPs/RoutableIPs patch, ChangePeerRoutes)
+// for the peer-scoped deltas already present on resp. It must run after
+// undeltaPeers, but the delta maps it reads (OnlineChange, PeersChangedPatch)
+// are left untouched by undeltaPeers, so they're still available here.
+func (ms *mapSession) publishPeerDeltas(resp *tailcfg.MapResponse) {
+	for nodeID, online := range resp.OnlineChange {
+		online := online
+		ms.publish(Change{Kind: ChangePeerOnline, NodeID: nodeID, Online: &online})
+	}
+	for _, ec := range resp.PeersChangedPatch {
+		if ec.Online != nil {
+			online := *ec.Online
+			ms.publish(Change{Kind: ChangePeerOnline, NodeID: ec.NodeID, Online: &online})
+		}
+		if ec.Endpoints != nil {
+			ms.publish(Change{Kind: ChangePeerEndpoints, NodeID: ec.NodeID, Endpoints: ec.Endpoints})
+		}
+		if ec.PrimaryRoutes != nil || ec.AllowedIPs != nil || ec.HostinfoRoutableIPs != nil {
+			ms.publish(Change{Kind: ChangePeerRoutes, NodeID: ec.NodeID})
+		}
+	}
+}
+
+// publishHAElectionChanges compares elected and candidateIDs, this call's HA
+// route election result and per-prefix advertiser set, against
+// ms.lastHAElected and ms.lastHACandidates, and publishes ChangePeerRoutes
+// for every peer whose demoted/undemoted status actually changed: a newly
+// or no-longer contested prefix, a prefix whose winner flipped, or a
+// candidate that joined or left a prefix's contest. It then stores elected
+// and candidateIDs as the new baseline for the next call.
+func (ms *mapSession) publishHAElectionChanges(elected map[netip.Prefix]tailcfg.NodeID, candidateIDs map[netip.Prefix][]tailcfg.NodeID) {
+	affected := make(map[tailcfg.NodeID]bool)
+	prefixes := make(map[netip.Prefix]bool, len(candidateIDs)+len(ms.lastHACandidates))
+	for prefix := range candidateIDs {
+		prefixes[prefix] = true
+	}
+	for prefix := range ms.lastHACandidates {
+		prefixes[prefix] = true
+	}
+	for prefix := range prefixes {
+		curWinner, curOK := elected[prefix]
+		prevWinner, prevOK := ms.lastHAElected[prefix]
+		if curOK != prevOK || curWinner != prevWinner {
+			if curOK {
+				affected[curWinner] = true
+			}
+			if prevOK {
+				affected[prevWinner] = true
+			}
+		}
+		curSet := idSet(candidateIDs[prefix])
+		prevSet := idSet(ms.lastHACandidates[prefix])
+		for id := range union(curSet, prevSet) {
+			demotedNow := curOK && curSet[id] && id != curWinner
+			demotedBefore := prevOK && prevSet[id] && id != prevWinner
+			if demotedNow != demotedBefore {
+				affected[id] = true
+			}
+		}
+	}
+	for nodeID := range affected {
+		ms.publish(Change{Kind: ChangePeerRoutes, NodeID: nodeID})
+	}
+	ms.lastHAElected = elected
+	ms.lastHACandidates = candidateIDs
+}
+
+// idSet returns ids as a set for membership testing.
+func idSet(ids []tailcfg.NodeID) map[tailcfg.NodeID]bool {
+	set := make(map[tailcfg.NodeID]bool, len(ids))
+	for _, id := range ids {
+		set[id] = true
+	}
+	return set
+}
+
+// union returns the set union of a and b.
+func union(a, b map[tailcfg.NodeID]bool) map[tailcfg.NodeID]bool {
+	u := make(map[tailcfg.NodeID]bool, len(a)+len(b))
+	for id := range a {
+		u[id] = true
+	}
+	for id := range b {
+		u[id] = true
+	}
+	return u
+}
+
 func (ms *mapSession) addUserProfile(userID tailcfg.UserID) {
 	if userID == 0 {
 		return
@@ -245,6 +458,7 @@ func (ms *mapSession) netmapForResponse(resp *tailcfg.MapResponse) *netmap.Netwo
 		}
 
 		ms.lastDERPMap = dm
+		ms.publish(Change{Kind: ChangeDERPMap, DERPMap: dm})
 	}
 
 	if pf := resp.PacketFilter; pf != nil {
@@ -254,12 +468,15 @@ func (ms *mapSession) netmapForResponse(resp *tailcfg.MapResponse) *netmap.Netwo
 		if err != nil {
 			ms.logf("parsePacketFilter: %v", err)
 		}
+		ms.publish(Change{Kind: ChangePacketFilter})
 	}
 	if c := resp.DNSConfig; c != nil {
 		ms.lastDNSConfig = c
+		ms.publish(Change{Kind: ChangeDNSConfig, DNSConfig: c})
 	}
 	if p := resp.SSHPolicy; p != nil {
 		ms.lastSSHPolicy = p
+		ms.publish(Change{Kind: ChangeSSHPolicy, SSHPolicy: p})
 	}
 
 	if v, ok := resp.CollectServices.Get(); ok {
@@ -267,6 +484,7 @@ func (ms *mapSession) netmapForResponse(resp *tailcfg.MapResponse) *netmap.Netwo
 	}
 	if resp.Domain != "" {
 		ms.lastDomain = resp.Domain
+		ms.publish(Change{Kind: ChangeDomain, Domain: resp.Domain})
 	}
 	if resp.DomainDataPlaneAuditLogID != "" {
 		ms.lastDomainAuditLogID = resp.DomainDataPlaneAuditLogID
@@ -276,13 +494,23 @@ func (ms *mapSession) netmapForResponse(resp *tailcfg.MapResponse) *netmap.Netwo
 	}
 	if resp.TKAInfo != nil {
 		ms.lastTKAInfo = resp.TKAInfo
+		ms.publish(Change{Kind: ChangeTKA})
 	}
 
+	ms.publishPeerDeltas(resp)
+
+	elected, candidateIDs := electHARoutes(resp.Peers, ms.clock().Now())
+	ms.publishHAElectionChanges(elected, candidateIDs)
+
 	// TODO(bradfitz): now that this is a view, remove some of the defensive
 	// cloning elsewhere in mapSession.
 	peerViews := make([]tailcfg.NodeView, len(resp.Peers))
 	for i, n := range resp.Peers {
-		peerViews[i] = n.View()
+		p := n
+		if demoted := demoteHAPeer(n, elected); demoted != nil {
+			p = demoted
+		}
+		peerViews[i] = p.View()
 	}
 
 	nm := &netmap.NetworkMap{
@@ -315,6 +543,9 @@ func (ms *mapSession) netmapForResponse(resp *tailcfg.MapResponse) *netmap.Netwo
 		ms.lastNode = resp.Node.View()
 	}
 	if node := ms.lastNode; node.Valid() {
+		if resp.Node != nil {
+			ms.publish(Change{Kind: ChangeSelfNode, SelfNode: node})
+		}
 		nm.SelfNode = node
 		nm.Expiry = node.KeyExpiry()
 		nm.Name = node.Name()
@@ -460,6 +691,20 @@ func undeltaPeers(mapRes *tailcfg.MapResponse, prev []*tailcfg.Node) {
 				if v := ec.KeySignature; v != nil {
 					n.KeySignature = v
 				}
+				if v := ec.PrimaryRoutes; v != nil {
+					n.PrimaryRoutes = *v
+				}
+				if v := ec.AllowedIPs; v != nil {
+					n.AllowedIPs = *v
+				}
+				if v := ec.HostinfoRoutableIPs; v != nil {
+					hi := n.Hostinfo.AsStruct()
+					if hi == nil {
+						hi = new(tailcfg.Hostinfo)
+					}
+					hi.RoutableIPs = *v
+					n.Hostinfo = hi.View()
+				}
 			}
 		}
 	}
@@ -469,6 +714,113 @@ func undeltaPeers(mapRes *tailcfg.MapResponse, prev []*tailcfg.Node) {
 	mapRes.PeersRemoved = nil
 }
 
+// electHARoutes returns, for every advertised route prefix that more than
+// one peer claims as a PrimaryRoute, the NodeID of the single peer that
+// should be active for that prefix. It also returns, for every advertised
+// route prefix regardless of contest count, the full set of NodeIDs
+// advertising it, so callers can tell a peer joining or leaving a prefix's
+// candidate set apart from one that was never in the running.
+//
+// The election is deterministic (lowest NodeID among eligible candidates)
+// so that every node in the network converges on the same answer from the
+// same MapResponse, without any coordination with control beyond the
+// advertised routes and liveness signals it already sends. Prefixes with
+// only one advertiser aren't included in the elected result, since there's
+// no HA conflict to resolve.
+func electHARoutes(peers []*tailcfg.Node, now time.Time) (elected map[netip.Prefix]tailcfg.NodeID, candidateIDs map[netip.Prefix][]tailcfg.NodeID) {
+	candidates := make(map[netip.Prefix][]*tailcfg.Node)
+	for _, p := range peers {
+		for _, r := range p.PrimaryRoutes {
+			candidates[r] = append(candidates[r], p)
+		}
+	}
+	candidateIDs = make(map[netip.Prefix][]tailcfg.NodeID, len(candidates))
+	for prefix, ps := range candidates {
+		ids := make([]tailcfg.NodeID, len(ps))
+		for i, p := range ps {
+			ids[i] = p.ID
+		}
+		candidateIDs[prefix] = ids
+		if len(ps) < 2 {
+			continue
+		}
+		if elected == nil {
+			elected = make(map[netip.Prefix]tailcfg.NodeID)
+		}
+		elected[prefix] = electHAPeer(ps, now)
+	}
+	return elected, candidateIDs
+}
+
+// electHAPeer picks the active peer among ps, all of which advertise the
+// same HA route prefix. It prefers the lowest NodeID among peers that are
+// online and haven't gone stale, falling back to the lowest NodeID overall
+// if every candidate currently looks down.
+func electHAPeer(ps []*tailcfg.Node, now time.Time) tailcfg.NodeID {
+	var best, bestEligible *tailcfg.Node
+	for _, p := range ps {
+		if best == nil || p.ID < best.ID {
+			best = p
+		}
+		if !haPeerEligible(p, now) {
+			continue
+		}
+		if bestEligible == nil || p.ID < bestEligible.ID {
+			bestEligible = p
+		}
+	}
+	if bestEligible != nil {
+		return bestEligible.ID
+	}
+	return best.ID
+}
+
+// haPeerEligible reports whether p is currently a viable candidate to be
+// the active peer for an HA route: it must not be explicitly marked
+// offline, and it must have been seen recently enough.
+func haPeerEligible(p *tailcfg.Node, now time.Time) bool {
+	if p.Online != nil && !*p.Online {
+		return false
+	}
+	if p.LastSeen != nil && now.Sub(*p.LastSeen) > haRouteStaleThreshold {
+		return false
+	}
+	return true
+}
+
+// demoteHAPeer returns a clone of n with any HA-contested routes that n
+// lost the election for removed from its AllowedIPs, or nil if n needs no
+// changes. elected maps a contested route prefix to the NodeID that won
+// the election for it, as computed by electHARoutes from PrimaryRoutes.
+//
+// demoteHAPeer only ever removes prefixes that are actually present in
+// n.AllowedIPs: it relies on AllowedIPs being a superset of PrimaryRoutes
+// (true for any peer whose advertised routes have been approved). A
+// PrimaryRoutes prefix that isn't mirrored into AllowedIPs — e.g. a route
+// that's advertised but not yet approved — contributes to the election but
+// has nothing to demote here, since a peer never routes traffic for a
+// prefix that isn't in its own AllowedIPs regardless of who wins.
+func demoteHAPeer(n *tailcfg.Node, elected map[netip.Prefix]tailcfg.NodeID) *tailcfg.Node {
+	if len(elected) == 0 {
+		return nil
+	}
+	var changed bool
+	kept := make([]netip.Prefix, 0, len(n.AllowedIPs))
+	for _, a := range n.AllowedIPs {
+		if activeID, ok := elected[a]; ok && activeID != n.ID {
+			changed = true
+			continue
+		}
+		kept = append(kept, a)
+	}
+	if !changed {
+		return nil
+	}
+	n = n.Clone()
+	n.AllowedIPs = kept
+	return n
+}
+
 // ptrCopy returns a pointer to a newly allocated shallow copy of *v.
 func ptrCopy[T any](v *T) *T {
 	if v == nil {
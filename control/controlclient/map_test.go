@@ -0,0 +1,368 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package controlclient
+
+import (
+	"net/netip"
+	"testing"
+	"time"
+
+	"tailscale.com/tailcfg"
+	"tailscale.com/types/key"
+	"tailscale.com/types/netmap"
+)
+
+// fakeNetmapUpdater is a no-op NetmapUpdater for tests that only care about
+// mapSession's Subscribe/publish behavior, not what UpdateFullNetmap does.
+type fakeNetmapUpdater struct{}
+
+func (fakeNetmapUpdater) UpdateFullNetmap(*netmap.NetworkMap) {}
+
+func mustPrefix(s string) netip.Prefix {
+	return netip.MustParsePrefix(s)
+}
+
+func onlinePtr(b bool) *bool { return &b }
+
+func timePtr(t time.Time) *time.Time { return &t }
+
+func TestElectHARoutes(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	r1 := mustPrefix("10.0.0.0/24")
+	r2 := mustPrefix("10.1.0.0/24")
+
+	tests := []struct {
+		name  string
+		peers []*tailcfg.Node
+		want  map[netip.Prefix]tailcfg.NodeID
+	}{
+		{
+			name: "initial election picks lowest NodeID",
+			peers: []*tailcfg.Node{
+				{ID: 2, Online: onlinePtr(true), PrimaryRoutes: []netip.Prefix{r1}},
+				{ID: 1, Online: onlinePtr(true), PrimaryRoutes: []netip.Prefix{r1}},
+			},
+			want: map[netip.Prefix]tailcfg.NodeID{r1: 1},
+		},
+		{
+			name: "single advertiser isn't a HA conflict",
+			peers: []*tailcfg.Node{
+				{ID: 1, Online: onlinePtr(true), PrimaryRoutes: []netip.Prefix{r1}},
+			},
+			want: nil,
+		},
+		{
+			name: "failover when the elected peer goes offline",
+			peers: []*tailcfg.Node{
+				{ID: 1, Online: onlinePtr(false), PrimaryRoutes: []netip.Prefix{r1}},
+				{ID: 2, Online: onlinePtr(true), PrimaryRoutes: []netip.Prefix{r1}},
+			},
+			want: map[netip.Prefix]tailcfg.NodeID{r1: 2},
+		},
+		{
+			name: "failback when the original peer comes back online",
+			peers: []*tailcfg.Node{
+				{ID: 1, Online: onlinePtr(true), PrimaryRoutes: []netip.Prefix{r1}},
+				{ID: 2, Online: onlinePtr(true), PrimaryRoutes: []netip.Prefix{r1}},
+			},
+			want: map[netip.Prefix]tailcfg.NodeID{r1: 1},
+		},
+		{
+			name: "multiple overlapping HA groups elect independently",
+			peers: []*tailcfg.Node{
+				{ID: 1, Online: onlinePtr(true), PrimaryRoutes: []netip.Prefix{r1}},
+				{ID: 2, Online: onlinePtr(true), PrimaryRoutes: []netip.Prefix{r1, r2}},
+				{ID: 3, Online: onlinePtr(true), PrimaryRoutes: []netip.Prefix{r2}},
+			},
+			want: map[netip.Prefix]tailcfg.NodeID{r1: 1, r2: 2},
+		},
+		{
+			name: "every candidate down falls back to the lowest NodeID",
+			peers: []*tailcfg.Node{
+				{ID: 1, Online: onlinePtr(false), PrimaryRoutes: []netip.Prefix{r1}},
+				{ID: 2, Online: onlinePtr(false), PrimaryRoutes: []netip.Prefix{r1}},
+			},
+			want: map[netip.Prefix]tailcfg.NodeID{r1: 1},
+		},
+		{
+			name: "a stale LastSeen makes a peer ineligible",
+			peers: []*tailcfg.Node{
+				{ID: 1, LastSeen: timePtr(now.Add(-2 * haRouteStaleThreshold)), PrimaryRoutes: []netip.Prefix{r1}},
+				{ID: 2, LastSeen: timePtr(now), PrimaryRoutes: []netip.Prefix{r1}},
+			},
+			want: map[netip.Prefix]tailcfg.NodeID{r1: 2},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, _ := electHARoutes(tt.peers, now)
+			if len(got) != len(tt.want) {
+				t.Fatalf("electHARoutes() = %v, want %v", got, tt.want)
+			}
+			for prefix, wantID := range tt.want {
+				if got[prefix] != wantID {
+					t.Errorf("prefix %v: elected %v, want %v", prefix, got[prefix], wantID)
+				}
+			}
+		})
+	}
+}
+
+func TestDemoteHAPeer(t *testing.T) {
+	r1 := mustPrefix("10.0.0.0/24")
+	other := mustPrefix("192.168.1.0/24")
+	elected := map[netip.Prefix]tailcfg.NodeID{r1: 1}
+
+	winner := &tailcfg.Node{ID: 1, AllowedIPs: []netip.Prefix{r1, other}}
+	if got := demoteHAPeer(winner, elected); got != nil {
+		t.Errorf("winner was demoted: %+v", got)
+	}
+
+	loser := &tailcfg.Node{ID: 2, AllowedIPs: []netip.Prefix{r1, other}}
+	got := demoteHAPeer(loser, elected)
+	if got == nil {
+		t.Fatal("loser wasn't demoted")
+	}
+	if len(got.AllowedIPs) != 1 || got.AllowedIPs[0] != other {
+		t.Errorf("demoted AllowedIPs = %v, want [%v]", got.AllowedIPs, other)
+	}
+
+	unaffected := &tailcfg.Node{ID: 3, AllowedIPs: []netip.Prefix{other}}
+	if got := demoteHAPeer(unaffected, elected); got != nil {
+		t.Errorf("unaffected peer was modified: %+v", got)
+	}
+}
+
+// TestDemoteHAPeerUnapprovedRoute documents the invariant demoteHAPeer
+// relies on: it only removes prefixes that are actually present in
+// AllowedIPs. A losing peer whose PrimaryRoutes contributed to the
+// election but whose AllowedIPs was never updated to match (e.g. an
+// advertised-but-not-yet-approved route) has nothing removed, since it was
+// never serving that prefix via AllowedIPs in the first place.
+func TestDemoteHAPeerUnapprovedRoute(t *testing.T) {
+	r1 := mustPrefix("10.0.0.0/24")
+	other := mustPrefix("192.168.1.0/24")
+	elected := map[netip.Prefix]tailcfg.NodeID{r1: 1}
+
+	loser := &tailcfg.Node{
+		ID:            2,
+		PrimaryRoutes: []netip.Prefix{r1},
+		AllowedIPs:    []netip.Prefix{other}, // r1 not yet approved into AllowedIPs
+	}
+	if got := demoteHAPeer(loser, elected); got != nil {
+		t.Errorf("unapproved route caused a demotion: %+v", got)
+	}
+}
+
+func TestUndeltaPeersRoutePatch(t *testing.T) {
+	prevAllowed := []netip.Prefix{mustPrefix("10.0.0.0/24")}
+	prev := []*tailcfg.Node{
+		{
+			ID:         1,
+			DERP:       "127.3.3.40:1",
+			Cap:        5,
+			Endpoints:  []string{"1.2.3.4:5"},
+			AllowedIPs: prevAllowed,
+		},
+	}
+
+	newAllowed := []netip.Prefix{mustPrefix("10.0.1.0/24")}
+	mapRes := &tailcfg.MapResponse{
+		PeersChangedPatch: []*tailcfg.PeerChange{
+			{NodeID: 1, AllowedIPs: &newAllowed},
+		},
+	}
+
+	undeltaPeers(mapRes, prev)
+
+	if len(mapRes.Peers) != 1 {
+		t.Fatalf("got %d peers, want 1", len(mapRes.Peers))
+	}
+	got := mapRes.Peers[0]
+	if len(got.AllowedIPs) != 1 || got.AllowedIPs[0] != newAllowed[0] {
+		t.Errorf("AllowedIPs = %v, want %v", got.AllowedIPs, newAllowed)
+	}
+	if got.DERP != prev[0].DERP {
+		t.Errorf("route-only patch disturbed DERP: got %q, want %q", got.DERP, prev[0].DERP)
+	}
+	if got.Cap != prev[0].Cap {
+		t.Errorf("route-only patch disturbed Cap: got %v, want %v", got.Cap, prev[0].Cap)
+	}
+	if len(got.Endpoints) != 1 || got.Endpoints[0] != prev[0].Endpoints[0] {
+		t.Errorf("route-only patch disturbed Endpoints: got %v, want %v", got.Endpoints, prev[0].Endpoints)
+	}
+}
+
+func TestUndeltaPeersHostinfoRoutableIPsPatch(t *testing.T) {
+	newRoutable := []netip.Prefix{mustPrefix("10.0.2.0/24")}
+
+	t.Run("with existing Hostinfo", func(t *testing.T) {
+		prev := []*tailcfg.Node{
+			{
+				ID:       1,
+				DERP:     "127.3.3.40:1",
+				Hostinfo: (&tailcfg.Hostinfo{OS: "linux", RoutableIPs: []netip.Prefix{mustPrefix("10.0.0.0/24")}}).View(),
+			},
+		}
+		mapRes := &tailcfg.MapResponse{
+			PeersChangedPatch: []*tailcfg.PeerChange{
+				{NodeID: 1, HostinfoRoutableIPs: &newRoutable},
+			},
+		}
+
+		undeltaPeers(mapRes, prev)
+
+		got := mapRes.Peers[0]
+		hi := got.Hostinfo.AsStruct()
+		if hi == nil {
+			t.Fatal("Hostinfo is nil after patch")
+		}
+		if len(hi.RoutableIPs) != 1 || hi.RoutableIPs[0] != newRoutable[0] {
+			t.Errorf("RoutableIPs = %v, want %v", hi.RoutableIPs, newRoutable)
+		}
+		if hi.OS != "linux" {
+			t.Errorf("RoutableIPs-only patch disturbed OS: got %q, want %q", hi.OS, "linux")
+		}
+		if got.DERP != prev[0].DERP {
+			t.Errorf("RoutableIPs-only patch disturbed DERP: got %q, want %q", got.DERP, prev[0].DERP)
+		}
+	})
+
+	t.Run("without existing Hostinfo", func(t *testing.T) {
+		prev := []*tailcfg.Node{
+			{ID: 1, DERP: "127.3.3.40:1"},
+		}
+		mapRes := &tailcfg.MapResponse{
+			PeersChangedPatch: []*tailcfg.PeerChange{
+				{NodeID: 1, HostinfoRoutableIPs: &newRoutable},
+			},
+		}
+
+		undeltaPeers(mapRes, prev)
+
+		got := mapRes.Peers[0]
+		hi := got.Hostinfo.AsStruct()
+		if hi == nil {
+			t.Fatal("Hostinfo is still nil after patch")
+		}
+		if len(hi.RoutableIPs) != 1 || hi.RoutableIPs[0] != newRoutable[0] {
+			t.Errorf("RoutableIPs = %v, want %v", hi.RoutableIPs, newRoutable)
+		}
+	})
+}
+
+func TestSubscribePeerChanges(t *testing.T) {
+	ms := newMapSession(key.NodePrivate{}, fakeNetmapUpdater{})
+	defer ms.Close()
+
+	ch := ms.Subscribe(ChangePeerOnline, ChangePeerRoutes)
+
+	// Establish the peer first, so the second response is a delta.
+	ms.netmapForResponse(&tailcfg.MapResponse{
+		Peers: []*tailcfg.Node{{ID: 1}},
+	})
+
+	newRoutes := []netip.Prefix{mustPrefix("10.0.0.0/24")}
+	offline := false
+	ms.netmapForResponse(&tailcfg.MapResponse{
+		OnlineChange: map[tailcfg.NodeID]bool{1: offline},
+		PeersChangedPatch: []*tailcfg.PeerChange{
+			{NodeID: 1, AllowedIPs: &newRoutes},
+		},
+	})
+
+	gotKinds := map[ChangeKind]bool{}
+	for i := 0; i < 2; i++ {
+		select {
+		case c := <-ch:
+			gotKinds[c.Kind] = true
+			if c.NodeID != 1 {
+				t.Errorf("Change #%d NodeID = %v, want 1", i, c.NodeID)
+			}
+		default:
+			t.Fatalf("missing expected Change #%d", i)
+		}
+	}
+	for _, want := range []ChangeKind{ChangePeerOnline, ChangePeerRoutes} {
+		if !gotKinds[want] {
+			t.Errorf("never received a Change of kind %v", want)
+		}
+	}
+	select {
+	case c := <-ch:
+		t.Fatalf("unexpected extra Change: %+v", c)
+	default:
+	}
+}
+
+func TestSubscribeFiltersUnwantedKinds(t *testing.T) {
+	ms := newMapSession(key.NodePrivate{}, fakeNetmapUpdater{})
+	defer ms.Close()
+
+	ch := ms.Subscribe(ChangeDomain)
+
+	ms.netmapForResponse(&tailcfg.MapResponse{DERPMap: &tailcfg.DERPMap{}})
+
+	select {
+	case c := <-ch:
+		t.Fatalf("got unwanted Change: %+v", c)
+	default:
+	}
+}
+
+// TestSubscribeHAElectionNotifiesDemotedLoser verifies that when a prefix
+// goes from uncontested to contested in a full (non-delta) peer resync,
+// ChangePeerRoutes fires for the newly demoted losing candidate as well as
+// the winner. This arrives via a full Peers resync rather than a
+// PeersChangedPatch, so publishPeerDeltas never sees the new candidate's
+// route and publishHAElectionChanges is the only thing that can notice it.
+func TestSubscribeHAElectionNotifiesDemotedLoser(t *testing.T) {
+	ms := newMapSession(key.NodePrivate{}, fakeNetmapUpdater{})
+	defer ms.Close()
+
+	r1 := mustPrefix("10.0.0.0/24")
+	ch := ms.Subscribe(ChangePeerRoutes)
+
+	// Establish peer 1 as the sole advertiser of r1 (uncontested) and peer
+	// 2 with no routes at all.
+	ms.netmapForResponse(&tailcfg.MapResponse{
+		Peers: []*tailcfg.Node{
+			{ID: 1, PrimaryRoutes: []netip.Prefix{r1}, AllowedIPs: []netip.Prefix{r1}},
+			{ID: 2},
+		},
+	})
+
+	// A full resync now has peer 2 also advertising r1, making it
+	// contested. Peer 1 (lower ID) wins and peer 2 is demoted, but neither
+	// peer has a PeersChangedPatch or OnlineChange entry this round.
+	ms.netmapForResponse(&tailcfg.MapResponse{
+		Peers: []*tailcfg.Node{
+			{ID: 1, PrimaryRoutes: []netip.Prefix{r1}, AllowedIPs: []netip.Prefix{r1}},
+			{ID: 2, PrimaryRoutes: []netip.Prefix{r1}, AllowedIPs: []netip.Prefix{r1}},
+		},
+	})
+
+	gotNodeIDs := map[tailcfg.NodeID]bool{}
+	for i := 0; i < 2; i++ {
+		select {
+		case c := <-ch:
+			if c.Kind != ChangePeerRoutes {
+				t.Errorf("Change #%d Kind = %v, want ChangePeerRoutes", i, c.Kind)
+			}
+			gotNodeIDs[c.NodeID] = true
+		default:
+			t.Fatalf("missing expected Change #%d", i)
+		}
+	}
+	for _, want := range []tailcfg.NodeID{1, 2} {
+		if !gotNodeIDs[want] {
+			t.Errorf("never received a ChangePeerRoutes for NodeID %v", want)
+		}
+	}
+	select {
+	case c := <-ch:
+		t.Fatalf("unexpected extra Change: %+v", c)
+	default:
+	}
+}
@@ -0,0 +1,69 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package tailcfg
+
+import (
+	"net/netip"
+	"time"
+
+	"tailscale.com/types/key"
+	"tailscale.com/types/tkatype"
+)
+
+// PeerChange represents a [Node] delta sent to a client that asked to
+// watch a peer for changes, as used in MapResponse.PeersChangedPatch.
+//
+// Every field other than NodeID is optional and is to be applied only if
+// non-nil.
+type PeerChange struct {
+	// NodeID is the node ID of the peer being changed.
+	NodeID NodeID
+
+	// DERPRegion, if non-zero, means that peer's home DERP region changed.
+	DERPRegion int `json:",omitempty"`
+
+	// Cap, if non-zero, means that peer's capability version changed.
+	Cap CapabilityVersion `json:",omitempty"`
+
+	// Endpoints, if non-nil, means that peer's UDP Endpoints changed.
+	// It replaces any existing value (not a delta).
+	Endpoints []string `json:",omitempty"`
+
+	// Key, if non-nil, means that peer's public key changed.
+	Key *key.NodePublic `json:",omitempty"`
+
+	// DiscoKey, if non-nil, means that peer's DiscoKey changed.
+	DiscoKey *key.DiscoPublic `json:",omitempty"`
+
+	// Online, if non-nil, means that peer's online changed.
+	Online *bool `json:",omitempty"`
+
+	// LastSeen, if non-nil, means that peer's LastSeen changed.
+	LastSeen *time.Time `json:",omitempty"`
+
+	// KeyExpiry, if non-nil, changes that peer's key expiry.
+	KeyExpiry *time.Time `json:",omitempty"`
+
+	// Capabilities, if non-nil, means that peer's capabilities changed.
+	// It replaces any existing value (not a delta).
+	Capabilities *[]NodeCapability `json:",omitempty"`
+
+	// KeySignature, if non-nil, changes that peer's key signature.
+	KeySignature tkatype.MarshaledSignature `json:",omitempty"`
+
+	// PrimaryRoutes, if non-nil, changes that peer's PrimaryRoutes (the
+	// subnet routes it's a primary router for, which clients use as the
+	// candidates of their HA subnet router election). It replaces any
+	// existing value (not a delta).
+	PrimaryRoutes *[]netip.Prefix `json:",omitempty"`
+
+	// AllowedIPs, if non-nil, changes that peer's AllowedIPs. It replaces
+	// any existing value (not a delta).
+	AllowedIPs *[]netip.Prefix `json:",omitempty"`
+
+	// HostinfoRoutableIPs, if non-nil, changes that peer's
+	// Hostinfo.RoutableIPs (the subnet routes it advertises, prior to any
+	// HA election). It replaces any existing value (not a delta).
+	HostinfoRoutableIPs *[]netip.Prefix `json:",omitempty"`
+}
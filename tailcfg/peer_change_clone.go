@@ -0,0 +1,80 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package tailcfg
+
+import (
+	"net/netip"
+	"time"
+
+	"tailscale.com/types/key"
+	"tailscale.com/types/tkatype"
+)
+
+// Clone makes a deep copy of PeerChange.
+// The result aliases no memory with the original.
+func (src *PeerChange) Clone() *PeerChange {
+	if src == nil {
+		return nil
+	}
+	dst := new(PeerChange)
+	*dst = *src
+	dst.Endpoints = append(src.Endpoints[:0:0], src.Endpoints...)
+	if dst.Key != nil {
+		dst.Key = new(key.NodePublic)
+		*dst.Key = *src.Key
+	}
+	if dst.DiscoKey != nil {
+		dst.DiscoKey = new(key.DiscoPublic)
+		*dst.DiscoKey = *src.DiscoKey
+	}
+	if dst.Online != nil {
+		dst.Online = new(bool)
+		*dst.Online = *src.Online
+	}
+	if dst.LastSeen != nil {
+		dst.LastSeen = new(time.Time)
+		*dst.LastSeen = *src.LastSeen
+	}
+	if dst.KeyExpiry != nil {
+		dst.KeyExpiry = new(time.Time)
+		*dst.KeyExpiry = *src.KeyExpiry
+	}
+	if dst.Capabilities != nil {
+		dst.Capabilities = new([]NodeCapability)
+		*dst.Capabilities = append((*src.Capabilities)[:0:0], (*src.Capabilities)...)
+	}
+	dst.KeySignature = append(src.KeySignature[:0:0], src.KeySignature...)
+	if dst.PrimaryRoutes != nil {
+		dst.PrimaryRoutes = new([]netip.Prefix)
+		*dst.PrimaryRoutes = append((*src.PrimaryRoutes)[:0:0], (*src.PrimaryRoutes)...)
+	}
+	if dst.AllowedIPs != nil {
+		dst.AllowedIPs = new([]netip.Prefix)
+		*dst.AllowedIPs = append((*src.AllowedIPs)[:0:0], (*src.AllowedIPs)...)
+	}
+	if dst.HostinfoRoutableIPs != nil {
+		dst.HostinfoRoutableIPs = new([]netip.Prefix)
+		*dst.HostinfoRoutableIPs = append((*src.HostinfoRoutableIPs)[:0:0], (*src.HostinfoRoutableIPs)...)
+	}
+	return dst
+}
+
+// A compilation failure here means this code must be regenerated to match
+// PeerChange's fields, by hand or with the cloner tool.
+var _PeerChangeCloneNeedsRegeneration = PeerChange(struct {
+	NodeID              NodeID
+	DERPRegion          int
+	Cap                 CapabilityVersion
+	Endpoints           []string
+	Key                 *key.NodePublic
+	DiscoKey            *key.DiscoPublic
+	Online              *bool
+	LastSeen            *time.Time
+	KeyExpiry           *time.Time
+	Capabilities        *[]NodeCapability
+	KeySignature        tkatype.MarshaledSignature
+	PrimaryRoutes       *[]netip.Prefix
+	AllowedIPs          *[]netip.Prefix
+	HostinfoRoutableIPs *[]netip.Prefix
+}{})
@@ -0,0 +1,15 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+// Package tailcfg contains types used by the Tailscale coordination server.
+package tailcfg
+
+// NodeID is an integer that uniquely identifies a node within a tailnet.
+type NodeID int64
+
+// CapabilityVersion represents a client's capability level. It's incremented
+// whenever a new capability is added.
+type CapabilityVersion int
+
+// NodeCapability names a capability applicable to a node.
+type NodeCapability string